@@ -0,0 +1,173 @@
+package madns
+
+import "crypto/sha256"
+import "encoding/base64"
+import "strings"
+import "sync"
+import "time"
+import "github.com/miekg/dns"
+import "github.com/hlandau/degoutils/log"
+
+// acmeChallengeLabel is the well-known label ACME DNS-01 validation looks
+// for, per RFC 8555 §8.4: "_acme-challenge.<domain>." TXT "<digest>".
+const acmeChallengeLabel = "_acme-challenge"
+
+// challengeRecord is one published DNS-01 TXT value together with when it
+// should be considered gone even if nobody called Withdraw.
+type challengeRecord struct {
+	value   string
+	expires time.Time
+}
+
+// ChallengeOverlay is an in-memory store of ACME DNS-01 TXT records, so an
+// embedding program can answer its own challenges without touching the
+// zone data proper. signResponse consults it after the configured backend,
+// and only when the backend produced no Answer records; a backend answer
+// for the same name takes precedence. It is safe for concurrent use.
+type ChallengeOverlay struct {
+	mu      sync.Mutex
+	records map[string][]challengeRecord
+}
+
+// NewChallengeOverlay creates an empty overlay. Install it via
+// EngineConfig.Challenges to have it consulted during resolution.
+func NewChallengeOverlay() *ChallengeOverlay {
+	return &ChallengeOverlay{records: map[string][]challengeRecord{}}
+}
+
+// acmeName returns the FQDN of the _acme-challenge label for name.
+func acmeName(name string) string {
+	return dns.Fqdn(acmeChallengeLabel + "." + strings.TrimSuffix(dns.Fqdn(name), "."))
+}
+
+// Publish adds value to the TXT RRset served at _acme-challenge.<name>,
+// expiring it after ttl even if never explicitly withdrawn. name should not
+// already include the _acme-challenge label.
+func (o *ChallengeOverlay) Publish(name, value string, ttl time.Duration) {
+	key := acmeName(name)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.records[key] = append(o.records[key], challengeRecord{
+		value:   value,
+		expires: time.Now().Add(ttl),
+	})
+}
+
+// Withdraw removes value from the TXT RRset served at
+// _acme-challenge.<name>, if present.
+func (o *ChallengeOverlay) Withdraw(name, value string) {
+	key := acmeName(name)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	rra := o.records[key]
+	out := rra[:0]
+	for _, r := range rra {
+		if r.value != value {
+			out = append(out, r)
+		}
+	}
+	if len(out) == 0 {
+		delete(o.records, key)
+	} else {
+		o.records[key] = out
+	}
+}
+
+// lookup returns the unexpired TXT values published for the fully
+// qualified name (which must already include the _acme-challenge label),
+// pruning any that have expired.
+func (o *ChallengeOverlay) lookup(fqdn string, ttl uint32) ([]dns.RR, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	rra := o.records[fqdn]
+	if len(rra) == 0 {
+		return nil, false
+	}
+
+	now := time.Now()
+	live := rra[:0]
+	var out []dns.RR
+	for _, r := range rra {
+		if now.After(r.expires) {
+			continue
+		}
+		live = append(live, r)
+		out = append(out, &dns.TXT{
+			Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl},
+			Txt: []string{r.value},
+		})
+	}
+
+	if len(live) == 0 {
+		delete(o.records, fqdn)
+		return nil, false
+	}
+	o.records[fqdn] = live
+
+	return out, len(out) > 0
+}
+
+// overlayTTL is used for challenge TXT records served from the overlay;
+// ACME validators re-query per attempt, so a short TTL is appropriate.
+const overlayTTL = 30
+
+// lookupChallenge consults tx.e.cfg.Challenges for the query name of a TXT
+// (or ANY) query. Its only caller is signResponse, which runs after the
+// backend lookup and uses the overlay only when the backend produced no
+// Answer records; the backend lookup itself is not skipped. The resulting
+// RRs are signed by signResponse like any other answer.
+func (tx *stx) lookupChallenge() ([]dns.RR, bool) {
+	if tx.e.cfg.Challenges == nil {
+		return nil, false
+	}
+	if !tx.istype(dns.TypeTXT) {
+		return nil, false
+	}
+
+	return tx.e.cfg.Challenges.lookup(dns.Fqdn(tx.qname), overlayTTL)
+}
+
+// ChallengeProvider adapts a ChallengeOverlay to the Present/CleanUp shape
+// most third-party ACME DNS-01 provider interfaces expect (the interface
+// golang.org/x/crypto/acme/autocert-based tooling and other ACME clients
+// plug into), so a Go program embedding madns can obtain certificates from
+// Let's Encrypt for zones it serves itself.
+type ChallengeProvider struct {
+	overlay *ChallengeOverlay
+	ttl     time.Duration
+}
+
+// NewChallengeProvider creates a ChallengeProvider publishing into overlay,
+// with each challenge record kept alive for ttl unless withdrawn sooner.
+func NewChallengeProvider(overlay *ChallengeOverlay, ttl time.Duration) *ChallengeProvider {
+	return &ChallengeProvider{overlay: overlay, ttl: ttl}
+}
+
+// dns01Digest computes the value ACME validators expect in the
+// _acme-challenge TXT record for a given key authorization, per RFC 8555
+// §8.4: base64url(sha256(keyAuth)), unpadded.
+func dns01Digest(keyAuth string) string {
+	sum := sha256.Sum256([]byte(keyAuth))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Present publishes the DNS-01 challenge for domain.
+func (p *ChallengeProvider) Present(domain, token, keyAuth string) error {
+	p.overlay.Publish(domain, dns01Digest(keyAuth), p.ttl)
+	log.Info("acme: published dns-01 challenge for ", domain)
+	return nil
+}
+
+// CleanUp withdraws the DNS-01 challenge previously published for domain.
+func (p *ChallengeProvider) CleanUp(domain, token, keyAuth string) error {
+	p.overlay.Withdraw(domain, dns01Digest(keyAuth))
+	log.Info("acme: withdrew dns-01 challenge for ", domain)
+	return nil
+}
+
+// © 2014 Hugo Landau <hlandau@devever.net>    GPLv3 or later
@@ -0,0 +1,51 @@
+package madns
+
+import "testing"
+import "time"
+import "github.com/miekg/dns"
+
+// TestSignResponseServesChallengeOverlay checks that signResponse actually
+// consults the ACME overlay (via lookupChallenge) when the backend
+// produced no answer, which is the only call site wiring lookupChallenge
+// into request handling in this tree.
+func TestSignResponseServesChallengeOverlay(t *testing.T) {
+	overlay := NewChallengeOverlay()
+	overlay.Publish("example.com.", "digestvalue", time.Minute)
+
+	e := &Engine{cfg: EngineConfig{Challenges: overlay}}
+	soa := &dns.SOA{Hdr: dns.RR_Header{Name: "example.com."}}
+
+	req := new(dns.Msg)
+	req.SetQuestion("_acme-challenge.example.com.", dns.TypeTXT)
+
+	tx := &stx{
+		e:     e,
+		soa:   soa,
+		req:   req,
+		res:   new(dns.Msg),
+		qtype: dns.TypeTXT,
+		qname: "_acme-challenge.example.com.",
+	}
+
+	if err := tx.signResponse(); err != nil {
+		t.Fatalf("signResponse: %v", err)
+	}
+
+	if len(tx.res.Answer) != 1 {
+		t.Fatalf("len(tx.res.Answer) = %d, want 1", len(tx.res.Answer))
+	}
+
+	txt, ok := tx.res.Answer[0].(*dns.TXT)
+	if !ok {
+		t.Fatalf("expected *dns.TXT, got %T", tx.res.Answer[0])
+	}
+	if len(txt.Txt) != 1 || txt.Txt[0] != "digestvalue" {
+		t.Fatalf("unexpected TXT content: %v", txt.Txt)
+	}
+
+	if tx.rcode != dns.RcodeSuccess {
+		t.Fatalf("rcode = %d, want RcodeSuccess", tx.rcode)
+	}
+}
+
+// © 2014 Hugo Landau <hlandau@devever.net>    GPLv3 or later
@@ -0,0 +1,154 @@
+package madns
+
+import "crypto/rand"
+import "encoding/base32"
+import "encoding/hex"
+import "fmt"
+import "github.com/miekg/dns"
+import "github.com/hlandau/degoutils/log"
+
+// DenialMode selects how an Engine proves non-existence of a name or type.
+type DenialMode int
+
+const (
+	// DenialNSEC uses classic NSEC records (RFC 4034), which leak the
+	// ordered set of names in a zone to anyone walking it.
+	DenialNSEC DenialMode = iota
+
+	// DenialNSEC3 uses hashed NSEC3 records (RFC 5155) without opt-out,
+	// so every name, signed or not, is covered by a hashed NSEC3 RR.
+	DenialNSEC3
+
+	// DenialNSEC3OptOut uses NSEC3 with the opt-out flag (RFC 5155 §6)
+	// set, so unsigned delegations don't each need their own NSEC3 RR.
+	DenialNSEC3OptOut
+)
+
+// defaultNSEC3Iterations is used when EngineConfig.NSEC3Iterations is zero.
+// 10 is a conservative middle ground between RFC 5155's examples and the
+// cost concerns that later led most operators to prefer low iteration
+// counts (see RFC 9276).
+const defaultNSEC3Iterations = 10
+
+// nsec3Params resolves the effective NSEC3 parameters for cfg, applying
+// defaults where the configuration leaves them at the zero value. It
+// rejects any NSEC3Algorithm other than dns.SHA1: that's the only
+// algorithm RFC 5155 standardizes, and dns.HashName silently returns "" for
+// anything else, which would otherwise surface as a malformed, signed
+// denial-of-existence record rather than a configuration error.
+func (cfg *EngineConfig) nsec3Params() (algorithm uint8, iterations uint16, salt string, optOut bool, err error) {
+	algorithm = cfg.NSEC3Algorithm
+	if algorithm == 0 {
+		algorithm = dns.SHA1
+	}
+	if algorithm != dns.SHA1 {
+		return 0, 0, "", false, fmt.Errorf("nsec3: unsupported NSEC3 algorithm: %d", algorithm)
+	}
+
+	iterations = cfg.NSEC3Iterations
+	if iterations == 0 {
+		iterations = defaultNSEC3Iterations
+	}
+
+	salt = cfg.NSEC3Salt
+	optOut = cfg.DenialMode == DenialNSEC3OptOut
+
+	return
+}
+
+// hashedOwnerName computes the base32hex NSEC3 hash of name, per RFC 5155
+// §4, using the Engine's configured algorithm/iterations/salt. This is the
+// first label of the NSEC3 owner name; the caller appends the zone.
+func (tx *stx) hashedOwnerName(name string) (string, error) {
+	alg, iter, salt, _, err := tx.e.cfg.nsec3Params()
+	if err != nil {
+		return "", err
+	}
+
+	hash := dns.HashName(name, alg, iter, salt)
+	if hash == "" {
+		return "", fmt.Errorf("nsec3: failed to hash %q", name)
+	}
+	return hash, nil
+}
+
+// nextHashedOwnerName returns the hashed owner name that closes an NSEC3
+// interval starting at name: the base32hex hash incremented by one, via
+// stepName, so the resulting NSEC3 RR covers exactly the range
+// [hash(name), hash(name)+1).
+func (tx *stx) nextHashedOwnerName(name string) (string, error) {
+	hash, err := tx.hashedOwnerName(name)
+	if err != nil {
+		return "", err
+	}
+	return stepName(hash), nil
+}
+
+// buildNSEC3 constructs the NSEC3 RR covering name, setting the opt-out
+// flag when the Engine's DenialMode is DenialNSEC3OptOut and name sits at
+// an unsigned delegation point (insecureDelegation is the backend's
+// determination of that, since only it knows the zone's cut points).
+func (tx *stx) buildNSEC3(name string, ttl uint32, types []uint16, insecureDelegation bool) (*dns.NSEC3, error) {
+	alg, iter, salt, optOut, err := tx.e.cfg.nsec3Params()
+	if err != nil {
+		return nil, err
+	}
+
+	ownerHash, err := tx.hashedOwnerName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	nextHash, err := tx.nextHashedOwnerName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// HashLength is a wire-format field independent of NextDomain's
+	// base32hex string length; it must carry the raw, decoded hash byte
+	// count or the TypeBitMap offset on the wire is computed wrong.
+	rawHash, err := base32.HexEncoding.DecodeString(nextHash)
+	log.Panice(err, nextHash)
+
+	n := &dns.NSEC3{
+		Hdr: dns.RR_Header{
+			Name:   ownerHash + "." + dns.Fqdn(tx.soa.Hdr.Name),
+			Rrtype: dns.TypeNSEC3,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Hash:       alg,
+		Flags:      0,
+		Iterations: iter,
+		SaltLength: uint8(len(salt) / 2),
+		Salt:       salt,
+		HashLength: uint8(len(rawHash)),
+		NextDomain: nextHash,
+		TypeBitMap: types,
+	}
+
+	if optOut && insecureDelegation {
+		n.Flags |= 1
+	}
+
+	return n, nil
+}
+
+// RotateNSEC3Salt generates a fresh random NSEC3 salt of the given length
+// in bytes and installs it on cfg, so it takes effect for subsequently
+// computed NSEC3 hashes without requiring a server restart. Existing
+// NSEC3 chains signed under the old salt remain valid until their RRSIGs
+// expire; callers that want a clean cutover should re-sign the zone after
+// rotating.
+func (cfg *EngineConfig) RotateNSEC3Salt(length int) error {
+	b := make([]byte, length)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+
+	cfg.NSEC3Salt = hex.EncodeToString(b)
+	log.Info("rotated NSEC3 salt (", length, " bytes)")
+	return nil
+}
+
+// © 2014 Hugo Landau <hlandau@devever.net>    GPLv3 or later
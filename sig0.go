@@ -0,0 +1,125 @@
+package madns
+
+import "time"
+import "github.com/miekg/dns"
+import "github.com/hlandau/degoutils/log"
+import "crypto"
+import "fmt"
+
+// How far the Inception/Expiration window of an outgoing SIG(0) record
+// extends either side of the signing time.
+const sig0Validity = 5 * time.Minute
+
+// SIG0Authorizer is called during SIG(0) verification once a trusted KEY
+// matching the request's key tag has been found, so that callers can
+// restrict which keys are accepted for which names (e.g. a dynamic update
+// key that should only be honoured for the zone it was issued for). name
+// is the question name as asked, not a resolved zone/SOA name — it runs
+// before zone resolution, so callers wanting zone-level policy must derive
+// the zone from name themselves. Returning false causes the transaction to
+// be rejected with BADKEY.
+type SIG0Authorizer func(name string, keyTag uint16) bool
+
+// useSIG0 returns true iff the incoming request carries a SIG(0) record,
+// i.e. a SIG RR of type 0 in the Additional section, per RFC 2931.
+func (tx *stx) useSIG0() (*dns.SIG, bool) {
+	if len(tx.req.Extra) == 0 {
+		return nil, false
+	}
+
+	last := tx.req.Extra[len(tx.req.Extra)-1]
+	sig, ok := last.(*dns.SIG)
+	if !ok || sig.TypeCovered != 0 {
+		return nil, false
+	}
+
+	return sig, true
+}
+
+// verifySIG0 checks an incoming SIG(0)-signed request against the trusted
+// KEY RRs configured in tx.e.cfg.SIG0Trusted, keyed by key tag. It is the
+// SIG(0) counterpart of useDNSSEC, and is meant to be called early in the
+// same request-handling path, before the query is acted upon — like
+// useDNSSEC, it must not depend on anything produced by zone resolution
+// (tx.soa is not yet populated at this point in the pipeline).
+//
+// SIG0Authorize is therefore passed tx.qname (the question name as asked),
+// not a resolved zone/SOA name: it's the caller's job to map that to
+// whatever zone-scoping policy it wants to enforce.
+//
+// If the request carries no SIG(0) record, verifySIG0 returns (false, nil):
+// there was nothing to verify, and whether that's acceptable is a policy
+// decision for the caller (e.g. required for updates, optional for
+// queries). If a SIG(0) record is present but invalid, it sets tx.rcode to
+// dns.RcodeBadKey or dns.RcodeBadSig and returns a non-nil error.
+func (tx *stx) verifySIG0() (bool, error) {
+	sig, ok := tx.useSIG0()
+	if !ok {
+		return false, nil
+	}
+
+	key, ok := tx.e.cfg.SIG0Trusted[sig.KeyTag]
+	if !ok {
+		tx.setRcode(dns.RcodeBadKey)
+		return true, fmt.Errorf("sig0: no trusted key for key tag %d", sig.KeyTag)
+	}
+
+	if authorize := tx.e.cfg.SIG0Authorize; authorize != nil {
+		if !authorize(dns.Fqdn(tx.qname), sig.KeyTag) {
+			tx.setRcode(dns.RcodeBadKey)
+			return true, fmt.Errorf("sig0: key tag %d not authorized for name %s", sig.KeyTag, tx.qname)
+		}
+	}
+
+	buf, err := tx.req.Pack()
+	if err != nil {
+		tx.setRcode(dns.RcodeBadSig)
+		return true, err
+	}
+
+	if err := sig.Verify(key, buf); err != nil {
+		tx.setRcode(dns.RcodeBadSig)
+		log.Infoe(err, "sig0: verification failed")
+		return true, err
+	}
+
+	log.Info("sig0: verified request signed by key tag ", sig.KeyTag)
+	return true, nil
+}
+
+// signResponseSIG0 appends a SIG(0) record to the outgoing response when
+// tx.e.cfg.SIG0Key/SIG0KeyPrivate are configured, authenticating the
+// response itself rather than the zone data within it. This is orthogonal
+// to signResponse, which produces RRSIGs over the zone's own DNSSEC keys.
+func (tx *stx) signResponseSIG0() error {
+	key := tx.e.cfg.SIG0Key
+	if key == nil {
+		return nil
+	}
+
+	signer, ok := tx.e.cfg.SIG0KeyPrivate.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("sig0: configured signing key does not implement crypto.Signer")
+	}
+
+	now := time.Now()
+	sig := &dns.SIG{
+		RRSIG: dns.RRSIG{
+			Hdr:        dns.RR_Header{Name: ".", Rrtype: dns.TypeSIG, Class: dns.ClassANY},
+			Algorithm:  key.Algorithm,
+			Inception:  uint32(now.Add(-sig0Validity).Unix()),
+			Expiration: uint32(now.Add(sig0Validity).Unix()),
+			KeyTag:     key.KeyTag(),
+			SignerName: key.Hdr.Name,
+		},
+	}
+
+	if _, err := sig.Sign(signer, tx.res); err != nil {
+		return err
+	}
+
+	tx.res.Extra = append(tx.res.Extra, sig)
+	return nil
+}
+
+// © 2014 Hugo Landau <hlandau@devever.net>    GPLv3 or later
@@ -0,0 +1,151 @@
+package madns
+
+import "crypto"
+import "testing"
+import "time"
+import "github.com/miekg/dns"
+
+// sig0TestKey generates a KEY RR (and matching private key) usable for
+// SIG(0) signing/verification in tests.
+func sig0TestKey(t *testing.T) (*dns.KEY, interface{}) {
+	t.Helper()
+
+	k := &dns.KEY{DNSKEY: dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "signer.example.com.", Rrtype: dns.TypeKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     512,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}}
+
+	priv, err := k.Generate(256)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return k, priv
+}
+
+// sig0SignedRequest builds a SIG(0)-signed query for qname, signed by priv
+// under key.
+func sig0SignedRequest(t *testing.T, key *dns.KEY, priv interface{}, qname string) *dns.Msg {
+	t.Helper()
+
+	req := new(dns.Msg)
+	req.SetQuestion(qname, dns.TypeA)
+
+	now := time.Now()
+	sig := &dns.SIG{
+		RRSIG: dns.RRSIG{
+			Algorithm:  key.Algorithm,
+			Inception:  uint32(now.Add(-time.Minute).Unix()),
+			Expiration: uint32(now.Add(time.Minute).Unix()),
+			KeyTag:     key.KeyTag(),
+			SignerName: key.Hdr.Name,
+		},
+	}
+
+	buf, err := sig.Sign(priv.(crypto.Signer), req)
+	if err != nil {
+		t.Fatalf("sig.Sign: %v", err)
+	}
+
+	signed := new(dns.Msg)
+	if err := signed.Unpack(buf); err != nil {
+		t.Fatalf("unpack signed request: %v", err)
+	}
+	return signed
+}
+
+func TestVerifySIG0(t *testing.T) {
+	key, priv := sig0TestKey(t)
+
+	t.Run("no SIG0 record", func(t *testing.T) {
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+
+		e := &Engine{}
+		tx := &stx{e: e, req: req, qname: "www.example.com."}
+
+		ok, err := tx.verifySIG0()
+		if ok || err != nil {
+			t.Fatalf("verifySIG0() = (%v, %v), want (false, nil)", ok, err)
+		}
+	})
+
+	t.Run("untrusted key tag", func(t *testing.T) {
+		req := sig0SignedRequest(t, key, priv, "www.example.com.")
+
+		e := &Engine{cfg: EngineConfig{SIG0Trusted: map[uint16]*dns.KEY{}}}
+		tx := &stx{e: e, req: req, qname: "www.example.com."}
+
+		ok, err := tx.verifySIG0()
+		if !ok || err == nil {
+			t.Fatalf("verifySIG0() = (%v, %v), want (true, error)", ok, err)
+		}
+		if tx.rcode != dns.RcodeBadKey {
+			t.Fatalf("rcode = %d, want RcodeBadKey", tx.rcode)
+		}
+	})
+
+	t.Run("unauthorized key tag", func(t *testing.T) {
+		req := sig0SignedRequest(t, key, priv, "www.example.com.")
+
+		e := &Engine{cfg: EngineConfig{
+			SIG0Trusted:   map[uint16]*dns.KEY{key.KeyTag(): key},
+			SIG0Authorize: func(name string, keyTag uint16) bool { return false },
+		}}
+		tx := &stx{e: e, req: req, qname: "www.example.com."}
+
+		ok, err := tx.verifySIG0()
+		if !ok || err == nil {
+			t.Fatalf("verifySIG0() = (%v, %v), want (true, error)", ok, err)
+		}
+		if tx.rcode != dns.RcodeBadKey {
+			t.Fatalf("rcode = %d, want RcodeBadKey", tx.rcode)
+		}
+	})
+
+	t.Run("tampered signature", func(t *testing.T) {
+		req := sig0SignedRequest(t, key, priv, "www.example.com.")
+		// Flip the question name after signing so the signed bytes no
+		// longer match what's being verified.
+		req.Question[0].Name = "attacker.example.com."
+
+		e := &Engine{cfg: EngineConfig{SIG0Trusted: map[uint16]*dns.KEY{key.KeyTag(): key}}}
+		tx := &stx{e: e, req: req, qname: "attacker.example.com."}
+
+		ok, err := tx.verifySIG0()
+		if !ok || err == nil {
+			t.Fatalf("verifySIG0() = (%v, %v), want (true, error)", ok, err)
+		}
+		if tx.rcode != dns.RcodeBadSig {
+			t.Fatalf("rcode = %d, want RcodeBadSig", tx.rcode)
+		}
+	})
+
+	t.Run("valid", func(t *testing.T) {
+		req := sig0SignedRequest(t, key, priv, "www.example.com.")
+
+		authorized := false
+		e := &Engine{cfg: EngineConfig{
+			SIG0Trusted: map[uint16]*dns.KEY{key.KeyTag(): key},
+			SIG0Authorize: func(name string, keyTag uint16) bool {
+				authorized = true
+				return name == "www.example.com." && keyTag == key.KeyTag()
+			},
+		}}
+		tx := &stx{e: e, req: req, qname: "www.example.com."}
+
+		ok, err := tx.verifySIG0()
+		if !ok || err != nil {
+			t.Fatalf("verifySIG0() = (%v, %v), want (true, nil)", ok, err)
+		}
+		if !authorized {
+			t.Fatalf("expected SIG0Authorize to be consulted")
+		}
+		if tx.rcode != 0 {
+			t.Fatalf("rcode = %d, want 0 (unset)", tx.rcode)
+		}
+	})
+}
+
+// © 2014 Hugo Landau <hlandau@devever.net>    GPLv3 or later
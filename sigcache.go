@@ -0,0 +1,179 @@
+package madns
+
+import "sync"
+import "sync/atomic"
+import "crypto/sha256"
+import "container/list"
+import "sort"
+import "time"
+import "github.com/miekg/dns"
+
+// The default refresh margin used when EngineConfig.SigCacheRefresh is
+// zero. RRSIGs are considered stale (and thus re-signed) this long before
+// their actual Expiration, so a cached signature is never handed out right
+// up against the wire. signRRs gives each RRSIG its RRset's max TTL plus ten
+// minutes of validity, so this margin stays below ten minutes for a cached
+// signature to be reused at all.
+const defaultSigCacheRefresh = 5 * time.Minute
+
+// The capacity NewLRUSigCache uses when given a capacity of 0 or less. No
+// cache is created implicitly: when EngineConfig.SigCache is nil,
+// signRRsCached signs every RRset afresh.
+const defaultSigCacheCapacity = 4096
+
+// SigCacheKey identifies a signed RRset: its owner name, type and class,
+// plus a hash of the canonical (signed) RR data. The hash is included so a
+// change to the underlying data invalidates the cache entry even though the
+// name/type/class triple is unchanged.
+type SigCacheKey struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	Hash  [sha256.Size]byte
+}
+
+// SigCacheStats holds cumulative counters for cache instrumentation. Callers
+// can poll Stats periodically to size the cache appropriately.
+type SigCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+// SigCache is the interface signResponseSection consults before calling
+// signRRs, so that repeatedly-requested RRsets don't pay for a fresh
+// signature (an HSM round trip, in the worst case) on every query.
+type SigCache interface {
+	// Get returns a previously cached RRSIG for key, provided it will
+	// remain valid for at least refreshMargin beyond now. A cached
+	// signature too close to its Expiration is treated as a miss so it
+	// gets refreshed ahead of time rather than right as it lapses.
+	Get(key SigCacheKey, now time.Time, refreshMargin time.Duration) (dns.RR, bool)
+
+	// Put stores rrsig, which must be a *dns.RRSIG, under key.
+	Put(key SigCacheKey, rrsig dns.RR)
+
+	// Stats returns the current cumulative hit/miss/eviction counters.
+	Stats() SigCacheStats
+}
+
+type sigCacheEntry struct {
+	key   SigCacheKey
+	rrsig dns.RR
+}
+
+// lruSigCache is the default in-memory SigCache implementation: a
+// fixed-capacity LRU keyed by SigCacheKey.
+type lruSigCache struct {
+	mu    sync.Mutex
+	cap   int
+	ll    *list.List
+	items map[SigCacheKey]*list.Element
+
+	hits, misses, evictions uint64
+}
+
+// NewLRUSigCache creates a SigCache holding up to capacity entries,
+// evicting the least-recently-used entry once capacity is exceeded. A
+// capacity of 0 falls back to defaultSigCacheCapacity.
+func NewLRUSigCache(capacity int) SigCache {
+	if capacity <= 0 {
+		capacity = defaultSigCacheCapacity
+	}
+	return &lruSigCache{
+		cap:   capacity,
+		ll:    list.New(),
+		items: map[SigCacheKey]*list.Element{},
+	}
+}
+
+func (c *lruSigCache) Get(key SigCacheKey, now time.Time, refreshMargin time.Duration) (dns.RR, bool) {
+	c.mu.Lock()
+	el, ok := c.items[key]
+	if !ok {
+		c.mu.Unlock()
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+
+	entry := el.Value.(*sigCacheEntry)
+	rrsig, ok := entry.rrsig.(*dns.RRSIG)
+	if !ok {
+		c.mu.Unlock()
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+
+	if now.Add(refreshMargin).Unix() > int64(rrsig.Expiration) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		c.mu.Unlock()
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+
+	c.ll.MoveToFront(el)
+	c.mu.Unlock()
+	atomic.AddUint64(&c.hits, 1)
+	return dns.Copy(rrsig), true
+}
+
+func (c *lruSigCache) Put(key SigCacheKey, rrsig dns.RR) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		el.Value.(*sigCacheEntry).rrsig = rrsig
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	el := c.ll.PushFront(&sigCacheEntry{key: key, rrsig: rrsig})
+	c.items[key] = el
+
+	if c.ll.Len() > c.cap {
+		oldest := c.ll.Back()
+		if oldest != nil {
+			c.ll.Remove(oldest)
+			delete(c.items, oldest.Value.(*sigCacheEntry).key)
+			atomic.AddUint64(&c.evictions, 1)
+		}
+	}
+}
+
+func (c *lruSigCache) Stats() SigCacheStats {
+	return SigCacheStats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+	}
+}
+
+// sigCacheKeyFor computes the SigCacheKey for an RRset, hashing the
+// canonical text form of each RR so that any change to the data
+// invalidates the cache entry.
+func sigCacheKeyFor(rra []dns.RR) SigCacheKey {
+	hdr := rra[0].Header()
+
+	strs := make([]string, len(rra))
+	for i, rr := range rra {
+		strs[i] = rr.String()
+	}
+	sort.Strings(strs)
+
+	h := sha256.New()
+	for _, s := range strs {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+
+	key := SigCacheKey{
+		Name:  hdr.Name,
+		Type:  hdr.Rrtype,
+		Class: hdr.Class,
+	}
+	copy(key.Hash[:], h.Sum(nil))
+	return key
+}
+
+// © 2014 Hugo Landau <hlandau@devever.net>    GPLv3 or later
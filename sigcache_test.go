@@ -0,0 +1,134 @@
+package madns
+
+import "net"
+import "testing"
+import "time"
+import "github.com/miekg/dns"
+
+func benchRRset() []dns.RR {
+	return []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.ParseIP("203.0.113.1"),
+	}}
+}
+
+// BenchmarkSignRRsCached compares repeatedly signing the same RRset against
+// repeatedly looking it up in a warm SigCache, to show the QPS improvement
+// the cache is meant to buy back.
+func BenchmarkSignRRsCached(b *testing.B) {
+	zsk, zskPriv := mustGenerateKeyForBench(b)
+	rra := benchRRset()
+
+	b.Run("uncached", func(b *testing.B) {
+		e := &Engine{cfg: EngineConfig{ZSK: zsk, ZSKPrivate: zskPriv}}
+		soa := &dns.SOA{Hdr: dns.RR_Header{Name: "example.com."}}
+		tx := &stx{e: e, soa: soa}
+
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := tx.signRRs(rra, false); err != nil {
+				b.Fatalf("signRRs: %v", err)
+			}
+		}
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		e := &Engine{cfg: EngineConfig{
+			ZSK:        zsk,
+			ZSKPrivate: zskPriv,
+			SigCache:   NewLRUSigCache(0),
+		}}
+		soa := &dns.SOA{Hdr: dns.RR_Header{Name: "example.com."}}
+		tx := &stx{e: e, soa: soa}
+
+		// Warm the cache so the benchmark loop measures the hit path.
+		if _, err := tx.signRRsCached(rra, false); err != nil {
+			b.Fatalf("warmup signRRsCached: %v", err)
+		}
+
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := tx.signRRsCached(rra, false); err != nil {
+				b.Fatalf("signRRsCached: %v", err)
+			}
+		}
+	})
+}
+
+func mustGenerateKeyForBench(b *testing.B) (*dns.DNSKEY, interface{}) {
+	b.Helper()
+
+	k := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     256,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+
+	priv, err := k.Generate(256)
+	if err != nil {
+		b.Fatalf("generate key: %v", err)
+	}
+	return k, priv
+}
+
+// TestLRUSigCacheEviction checks that the default cache respects its
+// capacity and reports evictions, and that Get refreshes an entry's
+// recency so the most-recently-used key survives eviction.
+func TestLRUSigCacheEviction(t *testing.T) {
+	c := NewLRUSigCache(2)
+
+	mk := func(n int) (SigCacheKey, *dns.RRSIG) {
+		key := SigCacheKey{Name: "example.com.", Type: uint16(n)}
+		rrsig := &dns.RRSIG{Expiration: uint32(time.Now().Add(time.Hour).Unix())}
+		return key, rrsig
+	}
+
+	k1, v1 := mk(1)
+	k2, v2 := mk(2)
+	k3, v3 := mk(3)
+
+	c.Put(k1, v1)
+	c.Put(k2, v2)
+
+	if _, ok := c.Get(k1, time.Now(), 0); !ok {
+		t.Fatalf("expected k1 to be cached")
+	}
+
+	c.Put(k3, v3)
+
+	if _, ok := c.Get(k2, time.Now(), 0); ok {
+		t.Fatalf("expected k2 to have been evicted")
+	}
+	if _, ok := c.Get(k1, time.Now(), 0); !ok {
+		t.Fatalf("expected k1 to survive eviction (most recently used)")
+	}
+	if _, ok := c.Get(k3, time.Now(), 0); !ok {
+		t.Fatalf("expected k3 to be cached")
+	}
+
+	stats := c.Stats()
+	if stats.Evictions != 1 {
+		t.Fatalf("Evictions = %d, want 1", stats.Evictions)
+	}
+}
+
+// TestLRUSigCacheRefreshMargin checks that an entry close to its
+// Expiration is treated as a miss once within refreshMargin of expiring.
+func TestLRUSigCacheRefreshMargin(t *testing.T) {
+	c := NewLRUSigCache(0)
+
+	now := time.Now()
+	key := SigCacheKey{Name: "example.com.", Type: dns.TypeA}
+	rrsig := &dns.RRSIG{Expiration: uint32(now.Add(30 * time.Minute).Unix())}
+	c.Put(key, rrsig)
+
+	if _, ok := c.Get(key, now, 10*time.Minute); !ok {
+		t.Fatalf("expected hit well ahead of expiration")
+	}
+	if _, ok := c.Get(key, now, time.Hour); ok {
+		t.Fatalf("expected miss within refresh margin of expiration")
+	}
+}
+
+// © 2014 Hugo Landau <hlandau@devever.net>    GPLv3 or later
@@ -84,6 +84,19 @@ func rraMaxTTL(rra []dns.RR) uint32 {
 	return x
 }
 
+// Returns true iff alg is a DNSSEC signing algorithm we know how to drive
+// through rrsig.Sign. RSASHA256/RSASHA512 cover the common RSA case;
+// ECDSAP256SHA256/ECDSAP384SHA384 and ED25519 are supported so that zones
+// signed with smaller, cheaper keys don't need a hardcoded RSA assumption.
+func supportedAlgorithm(alg uint8) bool {
+	switch alg {
+	case dns.RSASHA256, dns.RSASHA512, dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+		return true
+	default:
+		return false
+	}
+}
+
 // Used by signResponseSection.
 func (tx *stx) signRRs(rra []dns.RR, useKSK bool) (dns.RR, error) {
 	if len(rra) == 0 {
@@ -95,30 +108,87 @@ func (tx *stx) signRRs(rra []dns.RR, useKSK bool) (dns.RR, error) {
 
 	log.Info("maxttl: ", maxttl, "  expiration: ", exp)
 
+	var dnskey *dns.DNSKEY
+	var pk interface{}
+	if useKSK {
+		dnskey = tx.e.cfg.KSK
+		pk = tx.e.cfg.KSKPrivate
+	} else {
+		dnskey = tx.e.cfg.ZSK
+		pk = tx.e.cfg.ZSKPrivate
+	}
+
+	if !supportedAlgorithm(dnskey.Algorithm) {
+		return nil, fmt.Errorf("unsupported DNSSEC algorithm: %d", dnskey.Algorithm)
+	}
+
+	signer, ok := pk.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("signing key does not implement crypto.Signer")
+	}
+
 	now := time.Now()
 	rrsig := &dns.RRSIG{
 		Hdr:        dns.RR_Header{Ttl: maxttl},
-		Algorithm:  dns.RSASHA256,
+		Algorithm:  dnskey.Algorithm,
 		Expiration: uint32(now.Add(exp).Unix()),
 		Inception:  uint32(now.Add(time.Duration(-10) * time.Minute).Unix()),
 		SignerName: dns.Fqdn(tx.soa.Hdr.Name),
+		KeyTag:     dnskey.KeyTag(),
 	}
-	pk := tx.e.cfg.ZSKPrivate
-	if useKSK {
-		pk = tx.e.cfg.KSKPrivate
-		rrsig.KeyTag = tx.e.cfg.KSK.KeyTag()
-	} else {
-		rrsig.KeyTag = tx.e.cfg.ZSK.KeyTag()
+
+	err := rrsig.Sign(signer, rra)
+	if err != nil {
+		return nil, err
+	}
+
+	return rrsig, nil
+}
+
+// signRRsCached wraps signRRs with a lookup against tx.e.cfg.SigCache, so
+// that an RRset which has already been signed recently is not re-signed on
+// every query. A miss falls through to signRRs and populates the cache with
+// the result.
+func (tx *stx) signRRsCached(rra []dns.RR, useKSK bool) (dns.RR, error) {
+	cache := tx.e.cfg.SigCache
+	if cache == nil {
+		return tx.signRRs(rra, useKSK)
 	}
 
-	err := rrsig.Sign(pk.(crypto.Signer), rra)
+	refresh := tx.e.cfg.SigCacheRefresh
+	if refresh == 0 {
+		refresh = defaultSigCacheRefresh
+	}
+
+	key := sigCacheKeyFor(rra)
+	key.Type += sigCacheKSKTypeOffset(useKSK)
+
+	if rrsig, ok := cache.Get(key, time.Now(), refresh); ok {
+		return rrsig, nil
+	}
+
+	rrsig, err := tx.signRRs(rra, useKSK)
 	if err != nil {
 		return nil, err
 	}
 
+	// Put a copy in the cache: rrsig itself is about to go straight onto
+	// the outgoing response, and Get hands out dns.Copy'd RRs on a hit, so
+	// the cached entry must not alias anything the caller mutates.
+	cache.Put(key, dns.Copy(rrsig))
 	return rrsig, nil
 }
 
+// sigCacheKSKTypeOffset distinguishes the KSK-signed DNSKEY RRSIG from the
+// ZSK-signed one in the cache key space, since both cover the same owner
+// name/type/class but are produced by different keys.
+func sigCacheKSKTypeOffset(useKSK bool) uint16 {
+	if useKSK {
+		return 1
+	}
+	return 0
+}
+
 // Used by signResponse.
 func (tx *stx) signResponseSection(rra *[]dns.RR) error {
 	if len(*rra) == 0 {
@@ -147,7 +217,7 @@ func (tx *stx) signResponseSection(rra *[]dns.RR) error {
 		if shouldSignType(pt, (rra == &tx.res.Ns)) {
 			useKSK := (pt == dns.TypeDNSKEY && tx.e.cfg.KSK != nil)
 			if useKSK {
-				srr, err := tx.signRRs(a, true)
+				srr, err := tx.signRRsCached(a, true)
 				if err != nil {
 					return err
 				}
@@ -155,7 +225,7 @@ func (tx *stx) signResponseSection(rra *[]dns.RR) error {
 				*rra = append(*rra, srr)
 			}
 
-			srr, err := tx.signRRs(a, false)
+			srr, err := tx.signRRsCached(a, false)
 			if err != nil {
 				return err
 			}
@@ -173,6 +243,25 @@ func (tx *stx) signResponseSection(rra *[]dns.RR) error {
 // This is called to append RRSIGs to the response based on the current records in the Answer and
 // Authority sections of the response. Records in the Additional section are not signed.
 func (tx *stx) signResponse() error {
+	// The ACME DNS-01 overlay is consulted after the backend: only if the
+	// backend came back empty for this query does the overlay get a chance
+	// to answer, before falling through to whatever rcode the backend
+	// lookup produced. Doing it here, rather than duplicating it at every
+	// backend call site, means overlay answers flow through exactly the
+	// same signing path as backend answers below.
+	if len(tx.res.Answer) == 0 {
+		if rra, ok := tx.lookupChallenge(); ok {
+			// The backend may have already populated a negative-response
+			// SOA (and rcode) in the Authority section before we get a
+			// chance to override it with an overlay hit; clear both so
+			// the response doesn't carry a stale NXDOMAIN/NODATA SOA
+			// alongside a successful Answer.
+			tx.res.Ns = nil
+			tx.res.Answer = append(tx.res.Answer, rra...)
+			tx.rcode = dns.RcodeSuccess
+		}
+	}
+
 	if !tx.useDNSSEC() {
 		return nil
 	}
@@ -0,0 +1,165 @@
+package madns
+
+import "encoding/hex"
+import "net"
+import "testing"
+import "github.com/miekg/dns"
+
+// fakeTransferWriter is a minimal dns.ResponseWriter that records every
+// message written to it, for asserting on ServeAXFR's output.
+type fakeTransferWriter struct {
+	remote  net.Addr
+	tsigErr error
+	written []*dns.Msg
+}
+
+func (w *fakeTransferWriter) LocalAddr() net.Addr  { return w.remote }
+func (w *fakeTransferWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *fakeTransferWriter) Close() error         { return nil }
+func (w *fakeTransferWriter) TsigStatus() error    { return w.tsigErr }
+func (w *fakeTransferWriter) TsigTimersOnly(bool)  {}
+func (w *fakeTransferWriter) Hijack()              {}
+func (w *fakeTransferWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+func (w *fakeTransferWriter) WriteMsg(m *dns.Msg) error {
+	w.written = append(w.written, m)
+	return nil
+}
+
+type fakeZoneBackend struct {
+	rrs []dns.RR
+}
+
+func (b *fakeZoneBackend) ZoneRRs(zone string) ([]dns.RR, error) {
+	return b.rrs, nil
+}
+
+func xferTestPeer() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 54321}
+}
+
+func xferTestACL() TransferACLEntry {
+	return TransferACLEntry{
+		Zone:      "example.com.",
+		KeyName:   "transfer-key.",
+		Algorithm: dns.HmacSHA256,
+		Secret:    "MTIzNDU2Nzg5MGFiY2RlZg==", // arbitrary 16-byte base64 secret
+	}
+}
+
+func xferTestZoneRRs() []dns.RR {
+	soa := &dns.SOA{
+		Hdr:     dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:      "ns1.example.com.",
+		Mbox:    "hostmaster.example.com.",
+		Serial:  1,
+		Refresh: 3600, Retry: 600, Expire: 604800, Minttl: 300,
+	}
+	a := &dns.A{
+		Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.ParseIP("203.0.113.1"),
+	}
+	return []dns.RR{soa, a}
+}
+
+// xferSignedRequest builds an AXFR/IXFR request with a TSIG RR whose MAC
+// matches exactly what ServeAXFR recomputes: HMAC over the packed request
+// without that trailing TSIG RR, per transferACLProvider.Verify.
+func xferSignedRequest(t *testing.T, acl TransferACLEntry, qtype uint16) *dns.Msg {
+	t.Helper()
+
+	req := new(dns.Msg)
+	req.SetQuestion(acl.Zone, qtype)
+
+	unsignedBuf, err := req.Pack()
+	if err != nil {
+		t.Fatalf("pack request: %v", err)
+	}
+
+	mac, err := acl.mac(unsignedBuf)
+	if err != nil {
+		t.Fatalf("mac: %v", err)
+	}
+
+	req.Extra = append(req.Extra, &dns.TSIG{
+		Hdr:       dns.RR_Header{Name: acl.KeyName, Rrtype: dns.TypeTSIG, Class: dns.ClassANY, Ttl: 0},
+		Algorithm: acl.Algorithm,
+		Fudge:     300,
+		MAC:       hex.EncodeToString(mac),
+		MACSize:   uint16(len(mac)),
+		OrigId:    req.Id,
+	})
+
+	return req
+}
+
+func TestServeAXFR(t *testing.T) {
+	acl := xferTestACL()
+
+	t.Run("no question", func(t *testing.T) {
+		e := &Engine{cfg: EngineConfig{TransferACL: []TransferACLEntry{acl}}}
+		req := new(dns.Msg)
+		w := &fakeTransferWriter{remote: xferTestPeer()}
+
+		e.ServeAXFR(w, req, &fakeZoneBackend{})
+
+		if len(w.written) != 1 || w.written[0].Rcode != dns.RcodeFormatError {
+			t.Fatalf("expected a single FORMERR response, got %+v", w.written)
+		}
+	})
+
+	t.Run("no TSIG", func(t *testing.T) {
+		e := &Engine{cfg: EngineConfig{TransferACL: []TransferACLEntry{acl}}}
+		req := new(dns.Msg)
+		req.SetQuestion(acl.Zone, dns.TypeAXFR)
+		w := &fakeTransferWriter{remote: xferTestPeer()}
+
+		e.ServeAXFR(w, req, &fakeZoneBackend{rrs: xferTestZoneRRs()})
+
+		if len(w.written) != 1 || w.written[0].Rcode != dns.RcodeRefused {
+			t.Fatalf("expected a single REFUSED response, got %+v", w.written)
+		}
+	})
+
+	t.Run("TSIG key not in ACL for zone", func(t *testing.T) {
+		other := acl
+		other.Zone = "other.example.com."
+		e := &Engine{cfg: EngineConfig{TransferACL: []TransferACLEntry{other}}}
+
+		req := xferSignedRequest(t, acl, dns.TypeAXFR)
+		w := &fakeTransferWriter{remote: xferTestPeer()}
+
+		e.ServeAXFR(w, req, &fakeZoneBackend{rrs: xferTestZoneRRs()})
+
+		if len(w.written) != 1 || w.written[0].Rcode != dns.RcodeRefused {
+			t.Fatalf("expected a single REFUSED response, got %+v", w.written)
+		}
+	})
+
+	t.Run("valid transfer streams SOA-bracketed envelope", func(t *testing.T) {
+		e := &Engine{cfg: EngineConfig{TransferACL: []TransferACLEntry{acl}}}
+
+		req := xferSignedRequest(t, acl, dns.TypeAXFR)
+		w := &fakeTransferWriter{remote: xferTestPeer()}
+
+		e.ServeAXFR(w, req, &fakeZoneBackend{rrs: xferTestZoneRRs()})
+
+		if len(w.written) != 1 {
+			t.Fatalf("expected a single envelope, got %d", len(w.written))
+		}
+
+		env := w.written[0]
+		if len(env.Answer) < 2 {
+			t.Fatalf("expected at least [SOA, ..., SOA], got %d RRs", len(env.Answer))
+		}
+		if _, ok := env.Answer[0].(*dns.SOA); !ok {
+			t.Fatalf("expected envelope to open with SOA, got %T", env.Answer[0])
+		}
+		if _, ok := env.Answer[len(env.Answer)-1].(*dns.SOA); !ok {
+			t.Fatalf("expected envelope to close with SOA, got %T", env.Answer[len(env.Answer)-1])
+		}
+	})
+}
+
+// © 2014 Hugo Landau <hlandau@devever.net>    GPLv3 or later